@@ -0,0 +1,77 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// sstLikePayload returns data shaped like a RocksDB SST block: long runs
+// of repeated key prefixes and zero padding, the kind of content a
+// snapshot of a real state machine tends to produce and that framed
+// compression is expected to shrink substantially.
+func sstLikePayload(n int) []byte {
+	buf := make([]byte, 0, n)
+	key := []byte("user/00000000/profile/")
+	for len(buf) < n {
+		buf = append(buf, key...)
+		buf = append(buf, make([]byte, 40)...)
+	}
+	return buf[:n]
+}
+
+// incompressiblePayload returns random bytes, standing in for a
+// snapshot chunk that is already compressed (e.g. re-transferring a
+// gzipped blob embedded in application state).
+func incompressiblePayload(n int) []byte {
+	buf := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(buf)
+	return buf
+}
+
+func benchmarkEncode(b *testing.B, codec ChunkCodec, payload []byte) {
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := codec.Encode(payload); err != nil {
+			b.Fatalf("Encode failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkFrameCodecEncodeSST(b *testing.B) {
+	benchmarkEncode(b, frameCodec{}, sstLikePayload(4<<20))
+}
+
+func BenchmarkFrameCodecEncodeIncompressible(b *testing.B) {
+	benchmarkEncode(b, frameCodec{}, incompressiblePayload(4<<20))
+}
+
+func BenchmarkFrameCodecDecodeSST(b *testing.B) {
+	payload := sstLikePayload(4 << 20)
+	codec := frameCodec{}
+	encoded, err := codec.Encode(payload)
+	if err != nil {
+		b.Fatalf("Encode failed: %v", err)
+	}
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := codec.Decode(encoded); err != nil {
+			b.Fatalf("Decode failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"small", []byte("hello world")},
+		{"multi-frame", sstLikePayload(3 * frameSize)},
+	}
+	codec := frameCodec{}
+	for _, tt := range tests {
+		encoded, err := codec.Encode(tt.data)
+		if err != nil {
+			t.Fatalf("%s: Encode failed: %v", tt.name, err)
+		}
+		decoded, err := codec.Decode(encoded)
+		if err != nil {
+			t.Fatalf("%s: Decode failed: %v", tt.name, err)
+		}
+		if !bytes.Equal(decoded, tt.data) {
+			t.Fatalf("%s: round trip mismatch", tt.name)
+		}
+	}
+}
+
+func TestNegotiateChunkCodecFallsBackToNoop(t *testing.T) {
+	if c := negotiateChunkCodec([]string{"unknown-codec"}); c.Name() != (noopCodec{}).Name() {
+		t.Fatalf("negotiateChunkCodec() = %s, want noop when peer advertises nothing understood", c.Name())
+	}
+	if c := negotiateChunkCodec([]string{"unknown", (frameCodec{}).Name()}); c.Name() != (frameCodec{}).Name() {
+		t.Fatalf("negotiateChunkCodec() = %s, want %s", c.Name(), (frameCodec{}).Name())
+	}
+}
@@ -71,6 +71,22 @@ type connection struct {
 	failed             chan struct{}
 	streamChunkSent    atomic.Value
 	preStreamChunkSend atomic.Value
+	chunkStore         ChunkStore
+	transferID         transferID
+	resumeFrom         uint64
+	filePath           string
+	codec              ChunkCodec
+	peer               *peerHealth
+	priority           snapshotPriority
+	limiter            *bandwidthLimiter
+}
+
+// ICodecNegotiatingConnection is an optional interface a
+// raftio.ISnapshotConnection can implement to advertise the ChunkCodecs
+// it understands so the two ends of a snapshot transfer agree on
+// compression without requiring every transport to support it.
+type ICodecNegotiatingConnection interface {
+	AdvertisedCodecs() []string
 }
 
 func newConnection(ctx context.Context,
@@ -103,6 +119,21 @@ func (l *connection) close() {
 	}
 }
 
+// resumeFromChunk returns the ChunkId this connection should next send or
+// accept, read atomically since drain.go's handOff reads it from a
+// goroutine other than the one streaming or sending chunks.
+func (l *connection) resumeFromChunk() uint64 {
+	return atomic.LoadUint64(&l.resumeFrom)
+}
+
+// setResumeFrom advances the ChunkId this connection should next send or
+// accept, called both on reconnect and after every chunk actually placed
+// on the wire so a concurrent handOff persists real progress rather than
+// the value last reported at reconnect.
+func (l *connection) setResumeFrom(chunkID uint64) {
+	atomic.StoreUint64(&l.resumeFrom, chunkID)
+}
+
 func (l *connection) connect(addr string) error {
 	conn, err := l.rpc.GetSnapshotConnection(l.ctx, addr)
 	if err != nil {
@@ -110,6 +141,21 @@ func (l *connection) connect(addr string) error {
 		return err
 	}
 	l.conn = conn
+	l.codec = noopCodec{}
+	if negotiating, ok := conn.(ICodecNegotiatingConnection); ok {
+		l.codec = negotiateChunkCodec(negotiating.AdvertisedCodecs())
+	}
+	if resumable, ok := conn.(IResumableSnapshotConnection); ok && l.transferID != (transferID{}) {
+		next, err := resumable.ResumeSnapshot(l.transferID)
+		if err != nil {
+			plog.Errorf("failed to resume snapshot transfer to %s, %v", addr, err)
+			return err
+		}
+		if next > l.resumeFromChunk() {
+			plog.Infof("resuming snapshot transfer to %s from chunk %d", addr, next)
+			l.setResumeFrom(next)
+		}
+	}
 	return nil
 }
 
@@ -119,6 +165,9 @@ func (l *connection) sendSavedSnapshot(m pb.Message) {
 		plog.Panicf("cap of ch is %d, want %d", cap(l.ch), len(chunks))
 	}
 	for _, chunk := range chunks {
+		if chunk.ChunkId < l.resumeFromChunk() {
+			continue
+		}
 		select {
 		case l.ch <- chunk:
 		}
@@ -126,6 +175,11 @@ func (l *connection) sendSavedSnapshot(m pb.Message) {
 }
 
 func (l *connection) SendSnapshotChunk(chunk pb.SnapshotChunk) (bool, bool) {
+	if l.peer != nil && !l.peer.isActive() {
+		plog.Warningf("dropping snapshot chunk to %s, peer known inactive",
+			logutil.DescribeNode(chunk.ClusterId, chunk.NodeId))
+		return false, false
+	}
 	select {
 	case l.ch <- chunk:
 		return true, false
@@ -146,6 +200,18 @@ func (l *connection) process() error {
 	return l.processSavedSnapshot()
 }
 
+// processBounded runs process() with l.ctx temporarily replaced by ctx, so
+// anything process() blocks on that honours a context deadline -- notably
+// l.limiter.wait -- unblocks with ctx's error once ctx expires instead of
+// running on l.ctx's normally much longer lifetime. This is used by the
+// drainer so a rate limited send cannot outlive the drain deadline.
+func (l *connection) processBounded(ctx context.Context) error {
+	original := l.ctx
+	l.ctx = ctx
+	defer func() { l.ctx = original }()
+	return l.process()
+}
+
 func (l *connection) streamSnapshot() error {
 	for {
 		select {
@@ -157,11 +223,16 @@ func (l *connection) streamSnapshot() error {
 				plog.Infof("poison chunk received")
 				return ErrStreamSnapshot
 			}
+			if chunk.ChunkId < l.resumeFromChunk() {
+				continue
+			}
+			l.filePath = chunk.FilePath
 			if err := l.sendSnapshotChunk(chunk, l.conn); err != nil {
 				plog.Errorf("stream snapshot chunk to %s failed",
 					logutil.DescribeNode(chunk.ClusterId, chunk.NodeId))
 				return err
 			}
+			l.setResumeFrom(chunk.ChunkId + 1)
 			if chunk.ChunkCount == LastChunkCount {
 				return nil
 			}
@@ -176,8 +247,9 @@ func (l *connection) processSavedSnapshot() error {
 		case <-l.stopc:
 			return ErrStopped
 		case chunk := <-l.ch:
-			if len(chunks) == 0 && chunk.ChunkId != 0 {
-				panic("chunk alignment error")
+			if len(chunks) == 0 && chunk.ChunkId != l.resumeFromChunk() {
+				plog.Panicf("chunk alignment error, got chunk %d, resuming from %d",
+					chunk.ChunkId, l.resumeFromChunk())
 			}
 			chunks = append(chunks, chunk)
 			if chunk.ChunkId+1 == chunk.ChunkCount {
@@ -189,8 +261,11 @@ func (l *connection) processSavedSnapshot() error {
 
 func (l *connection) sendChunks(chunks []pb.SnapshotChunk) error {
 	for _, chunk := range chunks {
-		chunkData := make([]byte, snapChunkSize)
-		data, err := loadSnapshotChunkData(chunk, chunkData)
+		if chunk.ChunkId < l.resumeFromChunk() {
+			continue
+		}
+		l.filePath = chunk.FilePath
+		data, err := l.loadChunkData(chunk)
 		if err != nil {
 			plog.Errorf("failed to read the snapshot chunk, %v", err)
 			return err
@@ -202,6 +277,7 @@ func (l *connection) sendChunks(chunks []pb.SnapshotChunk) error {
 				logutil.DescribeNode(chunk.ClusterId, chunk.NodeId))
 			return err
 		}
+		l.setResumeFrom(chunk.ChunkId + 1)
 		if v := l.streamChunkSent.Load(); v != nil {
 			v.(func(pb.SnapshotChunk))(chunk)
 		}
@@ -209,8 +285,32 @@ func (l *connection) sendChunks(chunks []pb.SnapshotChunk) error {
 	return nil
 }
 
+// loadChunkData returns the raw bytes for chunk, preferring the pluggable
+// ChunkStore when one is configured so a resumed transfer does not need
+// the full chunks slice built by sendSavedSnapshot to still be resident
+// in memory.
+func (l *connection) loadChunkData(chunk pb.SnapshotChunk) ([]byte, error) {
+	if l.chunkStore != nil {
+		return l.chunkStore.LoadChunk(chunk.FileChunkId, chunk.FileChunkId*uint64(snapChunkSize), uint64(snapChunkSize))
+	}
+	chunkData := make([]byte, snapChunkSize)
+	return loadSnapshotChunkData(chunk, chunkData)
+}
+
 func (l *connection) sendSnapshotChunk(c pb.SnapshotChunk,
 	conn raftio.ISnapshotConnection) error {
+	if l.codec != nil {
+		encoded, err := l.codec.Encode(c.Data)
+		if err != nil {
+			plog.Errorf("failed to %s encode snapshot chunk, %v", l.codec.Name(), err)
+			return err
+		}
+		c.Data = encoded
+		c.Compression = l.codec.Name()
+	}
+	if err := l.limiter.wait(l.ctx, len(c.Data)); err != nil {
+		return err
+	}
 	if v := l.preStreamChunkSend.Load(); v != nil {
 		plog.Infof("pre stream chunk send set")
 		updated, shouldSend := v.(StreamChunkSendFunc)(c)
@@ -219,7 +319,22 @@ func (l *connection) sendSnapshotChunk(c pb.SnapshotChunk,
 			plog.Infof("not sending the chunk!")
 			return errChunkSendSkipped
 		}
-		return conn.SendSnapshotChunk(updated)
+		return l.recordSend(conn.SendSnapshotChunk(updated), len(updated.Data))
+	}
+	return l.recordSend(conn.SendSnapshotChunk(c), len(c.Data))
+}
+
+// recordSend feeds the outcome of a SendSnapshotChunk call into this
+// connection's peer health so a string of failures can flip it inactive
+// and so GetTransportStats reports bytes actually placed on the wire.
+func (l *connection) recordSend(err error, n int) error {
+	if l.peer == nil {
+		return err
 	}
-	return conn.SendSnapshotChunk(c)
-}
\ No newline at end of file
+	if err != nil {
+		l.peer.recordSendFailure()
+	} else {
+		l.peer.recordSnapshotBytes(uint64(n))
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDrainDeadline is how long DrainSnapshots waits for an in-flight
+// snapshot chunk to be flushed to a still reachable peer before giving up
+// on it and persisting a pendingSnapshot manifest instead.
+const defaultDrainDeadline = 30 * time.Second
+
+// DrainStats are the counters exposed alongside GetTransportStats so
+// operators can tell a clean rolling restart from one that is dropping
+// snapshot progress.
+type DrainStats struct {
+	ChunksDrained   uint64
+	ChunksHandedOff uint64
+	ChunksAbandoned uint64
+}
+
+// pendingSnapshot is the on-disk manifest written for a snapshot transfer
+// that could not be completed before shutdown, so a replacement or
+// restarted NodeHost can pick it back up via ResumePendingSnapshots
+// instead of asking the leader to resend the whole snapshot.
+type pendingSnapshot struct {
+	ClusterID uint64 `json:"clusterId"`
+	NodeID    uint64 `json:"nodeId"`
+	Term      uint64 `json:"term"`
+	Index     uint64 `json:"index"`
+	NextChunk uint64 `json:"nextChunk"`
+	FilePath  string `json:"filePath"`
+}
+
+func pendingSnapshotFileName(p pendingSnapshot) string {
+	return "pending-" + strconv.FormatUint(p.ClusterID, 10) + "-" +
+		strconv.FormatUint(p.NodeID, 10) + "-" +
+		strconv.FormatUint(p.Index, 10) + ".json"
+}
+
+// drainer owns the shutdown side of snapshot streaming: once draining
+// starts no new Sink is handed out and every active connection is given a
+// chance to flush what it is holding before the process exits.
+type drainer struct {
+	dir      string
+	deadline time.Duration
+	draining int32
+	stats    DrainStats
+	mu       sync.Mutex
+	tracked  map[transferID]*connection
+}
+
+func newDrainer(dir string, deadline time.Duration) *drainer {
+	if deadline <= 0 {
+		deadline = defaultDrainDeadline
+	}
+	return &drainer{dir: dir, deadline: deadline, tracked: make(map[transferID]*connection)}
+}
+
+// track registers an active connection so it is visited by DrainSnapshots.
+func (d *drainer) track(id transferID, l *connection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tracked[id] = l
+}
+
+func (d *drainer) untrack(id transferID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.tracked, id)
+}
+
+// get returns the connection tracked for id, if any, so a caller that
+// needs to reach into the connection before untracking it -- e.g. to
+// find which connPool it belongs to -- does not race a concurrent
+// DrainSnapshots walk over d.tracked.
+func (d *drainer) get(id transferID) (*connection, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	l, ok := d.tracked[id]
+	return l, ok
+}
+
+// isDraining reports whether new Sinks should be rejected.
+func (d *drainer) isDraining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// DrainSnapshots stops accepting new Sinks, then walks every tracked
+// connection, flushing what it can to still reachable peers within
+// deadline and persisting a pendingSnapshot manifest for the rest.
+func (d *drainer) DrainSnapshots(ctx context.Context) error {
+	atomic.StoreInt32(&d.draining, 1)
+	d.mu.Lock()
+	active := make(map[transferID]*connection, len(d.tracked))
+	for id, l := range d.tracked {
+		active[id] = l
+	}
+	d.mu.Unlock()
+	for id, l := range active {
+		dctx, cancel := context.WithTimeout(ctx, d.deadline)
+		err := d.drainOne(dctx, id, l)
+		cancel()
+		if err != nil {
+			plog.Warningf("failed to hand off snapshot transfer %v, %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (d *drainer) drainOne(ctx context.Context, id transferID, l *connection) error {
+	if l.conn == nil {
+		// never connected, there is nothing to flush to
+		return d.handOff(id, l)
+	}
+	done := make(chan error, 1)
+	go func() {
+		// processBounded ties any context-aware wait inside process(),
+		// e.g. the bandwidth limiter, to ctx so a rate limited send gives
+		// up at the drain deadline below. Waits on l.ch and l.stopc are not
+		// tied to ctx, so this goroutine can still be running after the
+		// transfer has been handed off.
+		done <- l.processBounded(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			atomic.AddUint64(&d.stats.ChunksDrained, 1)
+		}
+		return err
+	case <-ctx.Done():
+		return d.handOff(id, l)
+	}
+}
+
+// handOff persists a pendingSnapshot manifest for a transfer that could
+// not be completed within the drain deadline.
+func (d *drainer) handOff(id transferID, l *connection) error {
+	p := pendingSnapshot{
+		ClusterID: id.clusterID,
+		NodeID:    id.nodeID,
+		Term:      id.term,
+		Index:     id.index,
+		NextChunk: l.resumeFromChunk(),
+		FilePath:  l.filePath,
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		atomic.AddUint64(&d.stats.ChunksAbandoned, 1)
+		return err
+	}
+	fp := filepath.Join(d.dir, pendingSnapshotFileName(p))
+	if err := ioutil.WriteFile(fp, data, 0600); err != nil {
+		atomic.AddUint64(&d.stats.ChunksAbandoned, 1)
+		return err
+	}
+	atomic.AddUint64(&d.stats.ChunksHandedOff, 1)
+	return nil
+}
+
+// ResumePendingSnapshots is called on startup to pick up pendingSnapshot
+// manifests left behind by a previous process so interrupted transfers
+// continue from the recorded NextChunk, the chunk after the last one the
+// sender placed on the wire, rather than starting over.
+func ResumePendingSnapshots(dir string) ([]pendingSnapshot, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []pendingSnapshot
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			plog.Errorf("failed to read pending snapshot manifest %s, %v", e.Name(), err)
+			continue
+		}
+		var p pendingSnapshot
+		if err := json.Unmarshal(data, &p); err != nil {
+			plog.Errorf("failed to parse pending snapshot manifest %s, %v", e.Name(), err)
+			continue
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/lni/dragonboat/raftpb"
+)
+
+func TestHandOffPersistsFilePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	d := newDrainer(dir, 0)
+	id := newTransferID(1, 1, 2, 100)
+	l := &connection{resumeFrom: 5, filePath: "/data/snapshot/2-100/snapshot.bin"}
+	if err := d.handOff(id, l); err != nil {
+		t.Fatalf("handOff failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, pendingSnapshotFileName(pendingSnapshot{
+		ClusterID: id.clusterID, NodeID: id.nodeID, Index: id.index,
+	})))
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	var p pendingSnapshot
+	if err := json.Unmarshal(data, &p); err != nil {
+		t.Fatalf("failed to parse manifest: %v", err)
+	}
+	if p.FilePath != l.filePath {
+		t.Fatalf("manifest FilePath = %q, want %q", p.FilePath, l.filePath)
+	}
+	if p.NextChunk != l.resumeFromChunk() {
+		t.Fatalf("manifest NextChunk = %d, want %d", p.NextChunk, l.resumeFromChunk())
+	}
+}
+
+// TestHandOffPersistsActualStreamProgress guards against resumeFrom being
+// frozen at whatever value connect() last reported: it drives a handful of
+// chunks through sendChunks, as a real saved-snapshot transfer would, and
+// checks the manifest handOff persists reflects that progress rather than
+// the value the connection started with.
+func TestHandOffPersistsActualStreamProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fc := &fakeSnapshotConn{}
+	l := newConnection(context.Background(), 1, 1, 1, false, 8, nil, make(chan struct{}))
+	l.conn = fc
+	l.codec = noopCodec{}
+	l.chunkStore = fakeChunkStore{}
+	chunks := []pb.SnapshotChunk{
+		{ChunkId: 0, ChunkCount: 8, FileChunkId: 0, FilePath: "/data/snapshot/2-100/snapshot.bin"},
+		{ChunkId: 1, ChunkCount: 8, FileChunkId: 1, FilePath: "/data/snapshot/2-100/snapshot.bin"},
+		{ChunkId: 2, ChunkCount: 8, FileChunkId: 2, FilePath: "/data/snapshot/2-100/snapshot.bin"},
+	}
+	if err := l.sendChunks(chunks); err != nil {
+		t.Fatalf("sendChunks failed: %v", err)
+	}
+	if got := l.resumeFromChunk(); got != 3 {
+		t.Fatalf("resumeFromChunk() = %d after sending chunks 0-2, want 3", got)
+	}
+	d := newDrainer(dir, 0)
+	id := newTransferID(1, 1, 2, 100)
+	if err := d.handOff(id, l); err != nil {
+		t.Fatalf("handOff failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, pendingSnapshotFileName(pendingSnapshot{
+		ClusterID: id.clusterID, NodeID: id.nodeID, Index: id.index,
+	})))
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	var p pendingSnapshot
+	if err := json.Unmarshal(data, &p); err != nil {
+		t.Fatalf("failed to parse manifest: %v", err)
+	}
+	if p.NextChunk != 3 {
+		t.Fatalf("manifest NextChunk = %d, want 3, resumeFrom must track actual progress not just connect()'s last value", p.NextChunk)
+	}
+}
+
+// TestGetSinkRejectsOnceDraining guards the "stops accepting new Sinks"
+// half of DrainSnapshots' contract: isDraining used to be set but never
+// consulted anywhere, so a Sink handed out after shutdown began would
+// just be abandoned mid-transfer by the drain this Transport is already
+// running.
+func TestGetSinkRejectsOnceDraining(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tr := NewTransport(nil, TransportConfig{SnapshotDir: dir, DrainDeadline: time.Millisecond})
+	id := newTransferID(1, 1, 1, 1)
+	if s := tr.GetSink(context.Background(), 1, 1, 1, false, 1,
+		make(chan struct{}), "peer:1", id, nil, priorityForeground); s == nil {
+		t.Fatalf("GetSink() = nil before draining starts")
+	}
+	if err := tr.DrainSnapshots(context.Background()); err != nil {
+		t.Fatalf("DrainSnapshots failed: %v", err)
+	}
+	id2 := newTransferID(1, 1, 1, 2)
+	if s := tr.GetSink(context.Background(), 1, 1, 1, false, 1,
+		make(chan struct{}), "peer:1", id2, nil, priorityForeground); s != nil {
+		t.Fatalf("GetSink() returned a Sink after DrainSnapshots started")
+	}
+}
+
+// TestGetDrainStatsReflectsHandOff exercises GetDrainStats against the
+// same atomic.AddUint64 writers drainOne/handOff use, guarding against a
+// plain struct copy racing those writers under -race.
+func TestGetDrainStatsReflectsHandOff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tr := NewTransport(nil, TransportConfig{SnapshotDir: dir, DrainDeadline: time.Millisecond})
+	id := newTransferID(1, 1, 1, 1)
+	tr.NewConnection(context.Background(), 1, 1, 1, false, 1,
+		make(chan struct{}), "peer:1", id, nil, priorityForeground)
+	if err := tr.DrainSnapshots(context.Background()); err != nil {
+		t.Fatalf("DrainSnapshots failed: %v", err)
+	}
+	if stats := tr.GetDrainStats(); stats.ChunksHandedOff != 1 {
+		t.Fatalf("GetDrainStats().ChunksHandedOff = %d, want 1", stats.ChunksHandedOff)
+	}
+}
+
+func TestTransportTracksConnectionsForDraining(t *testing.T) {
+	tr := NewTransport(nil, TransportConfig{})
+	id := newTransferID(1, 1, 1, 1)
+	l := tr.NewConnection(context.Background(), 1, 1, 1, false, 1, make(chan struct{}), "peer:1", id, nil, priorityForeground)
+	if _, ok := tr.drainer.tracked[id]; !ok {
+		t.Fatalf("NewConnection did not register %v with the drainer", id)
+	}
+	if tr.drainer.tracked[id] != l {
+		t.Fatalf("drainer tracked a different connection than NewConnection returned")
+	}
+	tr.CloseConnection(id)
+	if _, ok := tr.drainer.tracked[id]; ok {
+		t.Fatalf("CloseConnection did not remove %v from the drainer", id)
+	}
+}
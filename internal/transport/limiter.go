@@ -0,0 +1,167 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// snapshotPriority distinguishes foreground transfers, e.g. a follower
+// catching up before it can serve reads, from background ones such as a
+// rebalance, so the scheduler can let the former preempt the latter at
+// chunk boundaries instead of treating every snapshot the same.
+type snapshotPriority int
+
+const (
+	priorityBackground snapshotPriority = iota
+	priorityForeground
+)
+
+// foregroundWeight/backgroundWeight control how many chunks a weighted
+// round robin dispatcher services from each priority class per round.
+const (
+	foregroundWeight = 4
+	backgroundWeight = 1
+)
+
+// ThrottleStats are the Prometheus style counters exposed alongside
+// GetTransportStats so operators can tell whether snapshot streaming is
+// being held back by the rate limiter.
+type ThrottleStats struct {
+	ChunksThrottled uint64
+	WaitNanos       uint64
+}
+
+// bandwidthLimiter wraps a token bucket limiter shared by every
+// connection on a NodeHost (or, when configured per cluster, by every
+// connection for that cluster) so snapshot streaming cannot starve
+// regular Raft replication traffic on the same link.
+type bandwidthLimiter struct {
+	limiter *rate.Limiter
+	stats   ThrottleStats
+}
+
+// newBandwidthLimiter returns a limiter capped at bytesPerSec, or nil when
+// bytesPerSec is zero meaning no cap is configured.
+func newBandwidthLimiter(bytesPerSec uint64) *bandwidthLimiter {
+	if bytesPerSec == 0 {
+		return nil
+	}
+	return &bandwidthLimiter{limiter: rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))}
+}
+
+// wait blocks the caller until n bytes worth of tokens are available,
+// recording how long it had to wait so the delay shows up in
+// ThrottleStats. A nil receiver is a no-op, used when no cap configured.
+func (b *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	start := time.Now()
+	throttled := false
+	var err error
+	// WaitN rejects requests larger than the burst, so take the tokens in
+	// burst sized steps.
+	for burst := b.limiter.Burst(); n > 0 && err == nil; n -= burst {
+		step := n
+		if step > burst {
+			step = burst
+		}
+		if !b.limiter.AllowN(time.Now(), step) {
+			throttled = true
+			err = b.limiter.WaitN(ctx, step)
+		}
+	}
+	if throttled {
+		atomic.AddUint64(&b.stats.WaitNanos, uint64(time.Since(start)))
+		atomic.AddUint64(&b.stats.ChunksThrottled, 1)
+	}
+	return err
+}
+
+// connPool is a small set of connection instances serving the same peer
+// at different priorities, dispatched using weighted round robin so a
+// foreground catch-up transfer gets more of the shared bandwidth budget
+// than a background rebalance without starving it outright.
+type connPool struct {
+	mu      sync.Mutex
+	byPri   map[snapshotPriority]*connection
+	credits int
+	limiter *bandwidthLimiter
+}
+
+// newConnPool creates a pool whose member connections all share the same
+// bandwidth cap, e.g. the per-cluster SnapshotSendBytesPerSecPerCluster
+// budget, so throttling is enforced across the pool rather than per
+// priority class.
+func newConnPool(limiter *bandwidthLimiter) *connPool {
+	return &connPool{
+		byPri:   make(map[snapshotPriority]*connection),
+		credits: weight(priorityForeground),
+		limiter: limiter,
+	}
+}
+
+func (p *connPool) set(pri snapshotPriority, l *connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l.priority = pri
+	l.limiter = p.limiter
+	p.byPri[pri] = l
+}
+
+// unset removes l's priority class from the pool, reporting whether the
+// pool is now empty so the caller can drop it from Transport.pools
+// instead of letting closed connections accumulate forever.
+func (p *connPool) unset(pri snapshotPriority) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.byPri, pri)
+	return len(p.byPri) == 0
+}
+
+func weight(pri snapshotPriority) int {
+	if pri == priorityForeground {
+		return foregroundWeight
+	}
+	return backgroundWeight
+}
+
+// dispatch picks the connection that should service the next chunk,
+// preferring whichever priority class still has weighted round robin
+// credits this round and falling back to whatever priority is present.
+func (p *connPool) dispatch() *connection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l, ok := p.byPri[priorityForeground]; ok {
+		if p.credits > 0 || p.byPri[priorityBackground] == nil {
+			if p.credits <= 0 {
+				p.credits = weight(priorityForeground)
+			}
+			p.credits--
+			return l
+		}
+	}
+	if l, ok := p.byPri[priorityBackground]; ok {
+		p.credits = weight(priorityForeground)
+		return l
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/raftio"
+)
+
+// resumeGCInterval is how often Transport sweeps its resume tracker for
+// idle or excess transfers.
+const resumeGCInterval = time.Minute
+
+// TransportConfig bundles the tunables for the snapshot chunk streaming
+// concerns owned by Transport: resuming interrupted transfers, draining
+// them on shutdown, probing peer health and throttling bandwidth. Zero
+// values fall back to the package defaults.
+type TransportConfig struct {
+	// ResumeWindow caps how many concurrent partially received transfers
+	// the resume tracker keeps state for.
+	ResumeWindow int
+	// ResumeIdleTimeout is how long a partially received transfer can sit
+	// without progress before it is discarded.
+	ResumeIdleTimeout time.Duration
+	// SnapshotDir is where pendingSnapshot manifests are written by
+	// DrainSnapshots and read back by ResumePendingSnapshots.
+	SnapshotDir string
+	// DrainDeadline bounds how long DrainSnapshots waits for an in-flight
+	// chunk to flush before handing the transfer off instead.
+	DrainDeadline time.Duration
+	// SnapshotSendBytesPerSec caps the node-wide outbound snapshot chunk
+	// rate. Zero means unlimited.
+	SnapshotSendBytesPerSec uint64
+	// SnapshotSendBytesPerSecPerCluster, when non zero, gives every
+	// cluster its own cap instead of sharing the node-wide one.
+	SnapshotSendBytesPerSecPerCluster uint64
+}
+
+// peerKey identifies the (cluster, node) pair a connPool arbitrates
+// between a foreground and a background snapshot transfer for.
+type peerKey struct {
+	clusterID uint64
+	nodeID    uint64
+}
+
+// Transport is the per NodeHost owner of the cross-cutting snapshot
+// streaming concerns implemented in this package. The bulk of snapshot
+// replication wiring lives with the caller (NodeHost and the raftio
+// transport implementation); Transport constructs and connects the
+// pieces declared here so they are reachable from real connections.
+type Transport struct {
+	cfg     TransportConfig
+	rpc     raftio.IRaftRPC
+	resumes *resumeTracker
+	drainer *drainer
+	prober  *prober
+	limiter *bandwidthLimiter
+
+	mu              sync.Mutex
+	clusterLimiters map[uint64]*bandwidthLimiter
+	pools           map[peerKey]*connPool
+}
+
+// NewTransport creates a Transport ready to back connections created
+// through it. Call Start to launch its background goroutines.
+func NewTransport(rpc raftio.IRaftRPC, cfg TransportConfig) *Transport {
+	t := &Transport{
+		cfg:             cfg,
+		rpc:             rpc,
+		resumes:         newResumeTracker(cfg.ResumeWindow, cfg.ResumeIdleTimeout),
+		drainer:         newDrainer(cfg.SnapshotDir, cfg.DrainDeadline),
+		limiter:         newBandwidthLimiter(cfg.SnapshotSendBytesPerSec),
+		clusterLimiters: make(map[uint64]*bandwidthLimiter),
+		pools:           make(map[peerKey]*connPool),
+	}
+	t.prober = newProber(rpc, t.onPeerTransition)
+	return t
+}
+
+// Start launches the background goroutines Transport depends on, all
+// stopped when ctx is cancelled.
+func (t *Transport) Start(ctx context.Context) {
+	go t.gcResumes(ctx)
+	go t.prober.run(ctx)
+}
+
+func (t *Transport) onPeerTransition(addr string, active bool) {
+	plog.Infof("peer %s transitioned to active=%t", addr, active)
+}
+
+func (t *Transport) gcResumes(ctx context.Context) {
+	ticker := time.NewTicker(resumeGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.resumes.gc()
+		}
+	}
+}
+
+// NewConnection creates a connection for a snapshot transfer to addr
+// identified by id, wiring in the transferID and ChunkStore so a
+// reconnect can resume from where the receiver left off instead of
+// chunk 0, registering it with the drainer so a shutdown mid-transfer
+// drains or hands it off instead of dropping it, attaching addr's
+// peerHealth so SendSnapshotChunk can fail fast against a known-dead
+// peer, and joining the (clusterID, nodeID) connPool at pri so a
+// foreground transfer can preempt a background one sharing the same
+// bandwidth cap at chunk boundaries.
+func (t *Transport) NewConnection(ctx context.Context, clusterID, nodeID, did uint64,
+	streaming bool, sz int, stopc chan struct{}, addr string,
+	id transferID, store ChunkStore, pri snapshotPriority) *connection {
+	l := newConnection(ctx, clusterID, nodeID, did, streaming, sz, t.rpc, stopc)
+	l.transferID = id
+	l.chunkStore = store
+	l.peer = t.prober.addPeer(addr)
+	t.drainer.track(id, l)
+	t.pool(clusterID, nodeID).set(pri, l)
+	return l
+}
+
+// GetSink returns a Sink wired up exactly like NewConnection for
+// receiving an incoming snapshot transfer, or nil once DrainSnapshots has
+// started: a Sink handed out after that point would only be abandoned
+// mid-transfer by the shutdown this Transport is already in the middle
+// of, so the caller should reject the transfer up front instead.
+func (t *Transport) GetSink(ctx context.Context, clusterID, nodeID, did uint64,
+	streaming bool, sz int, stopc chan struct{}, addr string,
+	id transferID, store ChunkStore, pri snapshotPriority) *Sink {
+	if t.drainer.isDraining() {
+		return nil
+	}
+	l := t.NewConnection(ctx, clusterID, nodeID, did, streaming, sz, stopc, addr, id, store, pri)
+	return &Sink{l: l}
+}
+
+// Dispatch returns the connection that should service the next chunk
+// for the (clusterID, nodeID) peer, preferring a foreground transfer
+// over a background one per the pool's weighted round robin policy.
+func (t *Transport) Dispatch(clusterID, nodeID uint64) *connection {
+	t.mu.Lock()
+	p, ok := t.pools[peerKey{clusterID: clusterID, nodeID: nodeID}]
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return p.dispatch()
+}
+
+// GetThrottleStats returns the chunks-throttled/time-waited counters
+// summed across the node-wide limiter and every per-cluster limiter
+// created so far, since a connection is throttled by exactly one of
+// the two depending on whether SnapshotSendBytesPerSecPerCluster is
+// configured.
+func (t *Transport) GetThrottleStats() ThrottleStats {
+	var stats ThrottleStats
+	addStats(&stats, t.limiter)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, l := range t.clusterLimiters {
+		addStats(&stats, l)
+	}
+	return stats
+}
+
+func addStats(dst *ThrottleStats, l *bandwidthLimiter) {
+	if l == nil {
+		return
+	}
+	dst.ChunksThrottled += atomic.LoadUint64(&l.stats.ChunksThrottled)
+	dst.WaitNanos += atomic.LoadUint64(&l.stats.WaitNanos)
+}
+
+func (t *Transport) pool(clusterID, nodeID uint64) *connPool {
+	key := peerKey{clusterID: clusterID, nodeID: nodeID}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pools[key]
+	if !ok {
+		p = newConnPool(t.clusterLimiterLocked(clusterID))
+		t.pools[key] = p
+	}
+	return p
+}
+
+// clusterLimiterLocked returns the bandwidthLimiter connections for
+// clusterID should share, creating a per-cluster one on first use when
+// SnapshotSendBytesPerSecPerCluster is configured, or falling back to
+// the node-wide limiter otherwise. t.mu must already be held.
+func (t *Transport) clusterLimiterLocked(clusterID uint64) *bandwidthLimiter {
+	if t.cfg.SnapshotSendBytesPerSecPerCluster == 0 {
+		return t.limiter
+	}
+	l, ok := t.clusterLimiters[clusterID]
+	if !ok {
+		l = newBandwidthLimiter(t.cfg.SnapshotSendBytesPerSecPerCluster)
+		t.clusterLimiters[clusterID] = l
+	}
+	return l
+}
+
+// GetTransportStats returns a point in time snapshot of PeerStatus for
+// every peer address this Transport has probed.
+func (t *Transport) GetTransportStats() map[string]PeerStatus {
+	return t.prober.GetTransportStats()
+}
+
+// CloseConnection removes a finished or abandoned transfer from drain
+// tracking so DrainSnapshots stops visiting it, and from its connPool so
+// Dispatch stops handing out a closed connection and the pool does not
+// outlive every transfer that ever used it.
+func (t *Transport) CloseConnection(id transferID) {
+	if l, ok := t.drainer.get(id); ok {
+		t.closePool(l)
+	}
+	t.drainer.untrack(id)
+}
+
+// closePool removes l from the (clusterID, nodeID) connPool it joined in
+// NewConnection, dropping the pool itself from t.pools once it no longer
+// has any connection left in it.
+func (t *Transport) closePool(l *connection) {
+	key := peerKey{clusterID: l.clusterID, nodeID: l.nodeID}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pools[key]
+	if !ok {
+		return
+	}
+	if p.unset(l.priority) {
+		delete(t.pools, key)
+	}
+}
+
+// DrainSnapshots stops accepting new Sinks and hands off or flushes
+// every tracked in-flight transfer. See drainer.DrainSnapshots.
+func (t *Transport) DrainSnapshots(ctx context.Context) error {
+	return t.drainer.DrainSnapshots(ctx)
+}
+
+// GetDrainStats returns the chunks-drained/handed-off/abandoned
+// counters accumulated by the drainer, read atomically since drainOne
+// and handOff update them with atomic.AddUint64 from the drain
+// goroutine while this can be called concurrently from anywhere.
+func (t *Transport) GetDrainStats() DrainStats {
+	return DrainStats{
+		ChunksDrained:   atomic.LoadUint64(&t.drainer.stats.ChunksDrained),
+		ChunksHandedOff: atomic.LoadUint64(&t.drainer.stats.ChunksHandedOff),
+		ChunksAbandoned: atomic.LoadUint64(&t.drainer.stats.ChunksAbandoned),
+	}
+}
+
+// ResumeSnapshot is the receiving side hook backing
+// IResumableSnapshotConnection.ResumeSnapshot: it reports the lowest
+// ChunkId not yet known to be durably written for id, which the raftio
+// snapshot connection handling the incoming RPC returns to the
+// reconnecting sender.
+func (t *Transport) ResumeSnapshot(id transferID) (uint64, error) {
+	return t.resumes.get(id).next(), nil
+}
+
+// AckResume records that chunkID of transfer id has been durably
+// written to disk. It is called by the snapshot chunk receive path once
+// a chunk is fsynced, advancing what ResumeSnapshot reports next.
+func (t *Transport) AckResume(id transferID, chunkID uint64) {
+	t.resumes.ack(id, chunkID)
+}
@@ -0,0 +1,192 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/raftio"
+)
+
+const (
+	// probeInterval is how often the background prober pings each known
+	// peer address to refresh its RTT and active status.
+	probeInterval = 3 * time.Second
+	// maxConsecutiveFailures is the number of failed probes, or failed
+	// sends, after which a peer is flipped from active to inactive.
+	maxConsecutiveFailures = 3
+)
+
+// PeerStatus reports on the health of a single peer address, modelled on
+// etcd rafthttp's peer status: a rolling RTT estimate, the last time we
+// heard from the peer and whether it currently looks reachable.
+type PeerStatus struct {
+	RTT               time.Duration
+	LastActive        time.Time
+	SendFailures      uint64
+	SnapshotBytesSent uint64
+	Active            bool
+}
+
+// peerHealth is the mutable, atomically swapped in counterpart of
+// PeerStatus tracked by the prober for a single address.
+type peerHealth struct {
+	mu                sync.Mutex
+	rtt               time.Duration
+	lastActive        time.Time
+	consecutiveFails  uint64
+	sendFailures      uint64
+	snapshotBytesSent uint64
+	active            bool
+}
+
+func (h *peerHealth) snapshot() PeerStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return PeerStatus{
+		RTT:               h.rtt,
+		LastActive:        h.lastActive,
+		SendFailures:      h.sendFailures,
+		SnapshotBytesSent: h.snapshotBytesSent,
+		Active:            h.active,
+	}
+}
+
+func (h *peerHealth) recordProbe(rtt time.Duration, err error, onTransition func(addr string, active bool)) {
+	h.mu.Lock()
+	wasActive := h.active
+	if err != nil {
+		h.consecutiveFails++
+		if h.consecutiveFails >= maxConsecutiveFailures {
+			h.active = false
+		}
+	} else {
+		h.consecutiveFails = 0
+		h.rtt = rtt
+		h.lastActive = time.Now()
+		h.active = true
+	}
+	becameActive := h.active
+	h.mu.Unlock()
+	if onTransition != nil && wasActive != becameActive {
+		onTransition("", becameActive)
+	}
+}
+
+func (h *peerHealth) recordSendFailure() {
+	h.mu.Lock()
+	h.sendFailures++
+	h.consecutiveFails++
+	if h.consecutiveFails >= maxConsecutiveFailures {
+		h.active = false
+	}
+	h.mu.Unlock()
+}
+
+func (h *peerHealth) recordSnapshotBytes(n uint64) {
+	atomic.AddUint64(&h.snapshotBytesSent, n)
+	h.mu.Lock()
+	h.consecutiveFails = 0
+	h.mu.Unlock()
+}
+
+func (h *peerHealth) isActive() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.active
+}
+
+// prober periodically issues raftio.IRaftRPC.Probe calls against every
+// known peer address and keeps a sync.Map of the resulting PeerStatus so
+// GetTransportStats can report live numbers without blocking on the hot
+// replication path.
+type prober struct {
+	rpc      raftio.IRaftRPC
+	peers    sync.Map // addr string -> *peerHealth
+	stopc    chan struct{}
+	onChange func(addr string, active bool)
+}
+
+func newProber(rpc raftio.IRaftRPC, onChange func(addr string, active bool)) *prober {
+	return &prober{rpc: rpc, stopc: make(chan struct{}), onChange: onChange}
+}
+
+func (p *prober) stop() {
+	close(p.stopc)
+}
+
+// addPeer registers addr for periodic probing if it is not already
+// known. A freshly registered peer starts out active: "known inactive"
+// requires actual negative evidence (a failed probe or send), so a
+// brand new connection is never fail-fast-rejected before it has had a
+// chance to be probed.
+func (p *prober) addPeer(addr string) *peerHealth {
+	v, _ := p.peers.LoadOrStore(addr, &peerHealth{active: true})
+	return v.(*peerHealth)
+}
+
+func (p *prober) health(addr string) (*peerHealth, bool) {
+	v, ok := p.peers.Load(addr)
+	if !ok {
+		return nil, false
+	}
+	return v.(*peerHealth), true
+}
+
+// run is the background probing goroutine, started once per transport
+// manager instance.
+func (p *prober) run(ctx context.Context) {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopc:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.probeAll(ctx)
+		}
+	}
+}
+
+func (p *prober) probeAll(ctx context.Context) {
+	p.peers.Range(func(key, value interface{}) bool {
+		addr := key.(string)
+		h := value.(*peerHealth)
+		rtt, err := p.rpc.Probe(ctx, addr)
+		wasActive := h.isActive()
+		h.recordProbe(rtt, err, nil)
+		isActive := h.isActive()
+		if p.onChange != nil && wasActive != isActive {
+			p.onChange(addr, isActive)
+		}
+		return true
+	})
+}
+
+// GetTransportStats returns a point in time snapshot of PeerStatus for
+// every peer address known to the prober, keyed by that address.
+func (p *prober) GetTransportStats() map[string]PeerStatus {
+	result := make(map[string]PeerStatus)
+	p.peers.Range(func(key, value interface{}) bool {
+		result[key.(string)] = value.(*peerHealth).snapshot()
+		return true
+	})
+	return result
+}
@@ -0,0 +1,74 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/lni/dragonboat/raftpb"
+)
+
+func TestTransportNewConnectionAttachesPeerHealth(t *testing.T) {
+	tr := NewTransport(nil, TransportConfig{})
+	id := newTransferID(1, 1, 1, 1)
+	l := tr.NewConnection(context.Background(), 1, 1, 1, false, 1, make(chan struct{}), "peer:1", id, nil, priorityForeground)
+	if l.peer == nil {
+		t.Fatalf("NewConnection did not attach peerHealth")
+	}
+	h, ok := tr.prober.health("peer:1")
+	if !ok || h != l.peer {
+		t.Fatalf("prober does not know about the peerHealth handed to the connection")
+	}
+}
+
+func TestNewlyAddedPeerStartsActive(t *testing.T) {
+	p := newProber(nil, nil)
+	h := p.addPeer("peer:1")
+	if !h.isActive() {
+		t.Fatalf("a peer that has never been probed must start active, not fail-fast rejected")
+	}
+}
+
+func TestSendSnapshotChunkAcceptsChunkForUnprobedPeer(t *testing.T) {
+	tr := NewTransport(nil, TransportConfig{})
+	id := newTransferID(1, 1, 1, 1)
+	l := tr.NewConnection(context.Background(), 1, 1, 1, false, 1, make(chan struct{}), "peer:1", id, nil, priorityForeground)
+	ok, stopped := l.SendSnapshotChunk(pb.SnapshotChunk{})
+	if !ok || stopped {
+		t.Fatalf("SendSnapshotChunk() = %t, %t, want true, false for a brand new, not yet probed peer", ok, stopped)
+	}
+}
+
+func TestSendSnapshotChunkFailsFastOnInactivePeer(t *testing.T) {
+	l := &connection{
+		ch:     make(chan pb.SnapshotChunk, 1),
+		failed: make(chan struct{}),
+		stopc:  make(chan struct{}),
+	}
+	l.peer = &peerHealth{}
+	for i := 0; i < maxConsecutiveFailures; i++ {
+		l.peer.recordSendFailure()
+	}
+	ok, stopped := l.SendSnapshotChunk(pb.SnapshotChunk{})
+	if ok || stopped {
+		t.Fatalf("SendSnapshotChunk() = %t, %t, want false, false against a known-inactive peer", ok, stopped)
+	}
+	select {
+	case <-l.ch:
+		t.Fatalf("chunk should not have been queued for a known-inactive peer")
+	default:
+	}
+}
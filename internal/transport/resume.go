@@ -0,0 +1,199 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxResumeWindow is the maximum number of in-flight transfers
+	// the resume tracker keeps partial state for when TransportConfig
+	// does not override it.
+	defaultMaxResumeWindow = 4096
+	// defaultResumeIdleTimeout is how long a partially received snapshot
+	// transfer can sit without progress before it is discarded, used when
+	// TransportConfig does not override it.
+	defaultResumeIdleTimeout = 5 * time.Minute
+)
+
+// transferID uniquely identifies a single snapshot transfer so a sender
+// reconnecting after a dropped RPC and the receiver that has been holding
+// partial state can agree on where to resume.
+type transferID struct {
+	clusterID uint64
+	nodeID    uint64
+	term      uint64
+	index     uint64
+}
+
+func newTransferID(clusterID uint64, nodeID uint64, term uint64, index uint64) transferID {
+	return transferID{clusterID: clusterID, nodeID: nodeID, term: term, index: index}
+}
+
+// ChunkStore lets the sender side of a snapshot transfer load the raw bytes
+// of a previously generated chunk on resume without requiring the original
+// in memory chunk slice produced by splitSnapshotMessage to still be around.
+type ChunkStore interface {
+	// LoadChunk returns the raw, uncompressed bytes for the chunk
+	// identified by fileChunkID starting at offset.
+	LoadChunk(fileChunkID uint64, offset uint64, sz uint64) ([]byte, error)
+}
+
+// IResumableSnapshotConnection is an optional interface that a
+// raftio.ISnapshotConnection implementation can provide to support
+// resuming an interrupted snapshot transfer instead of restarting it from
+// ChunkId 0. connection type asserts for it right after connect.
+type IResumableSnapshotConnection interface {
+	// ResumeSnapshot tells the receiver that the sender is reconnecting
+	// for the transfer identified by id. The returned nextChunkID is the
+	// ChunkId of the next chunk the receiver has not yet durably written,
+	// i.e. everything below it can be skipped by the sender.
+	ResumeSnapshot(id transferID) (nextChunkID uint64, err error)
+}
+
+// resumeWindow tracks, on the receiving side, the highest contiguous
+// ChunkId that has been durably written to disk for a single transfer.
+// Chunks can arrive with gaps after a reconnect race, so acks above
+// nextChunk are recorded until the gap below them closes.
+type resumeWindow struct {
+	mu          sync.Mutex
+	acked       map[uint64]struct{}
+	nextChunk   uint64
+	updatedAt   time.Time
+	idleTimeout time.Duration
+}
+
+func newResumeWindow(idleTimeout time.Duration) *resumeWindow {
+	return &resumeWindow{
+		acked:       make(map[uint64]struct{}),
+		updatedAt:   time.Now(),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// ack records chunkID as durably written and advances nextChunk past any
+// now-contiguous run of acked chunks.
+func (w *resumeWindow) ack(chunkID uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if chunkID >= w.nextChunk {
+		w.acked[chunkID] = struct{}{}
+	}
+	for {
+		if _, ok := w.acked[w.nextChunk]; !ok {
+			break
+		}
+		delete(w.acked, w.nextChunk)
+		w.nextChunk++
+	}
+	w.updatedAt = time.Now()
+}
+
+func (w *resumeWindow) next() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nextChunk
+}
+
+func (w *resumeWindow) idle(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return now.Sub(w.updatedAt) > w.idleTimeout
+}
+
+func (w *resumeWindow) lastUpdate() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.updatedAt
+}
+
+// resumeTracker keeps one resumeWindow per in-flight transfer on the
+// receiving side and discards windows that have gone idle, or the
+// oldest windows once more than maxWindow transfers are tracked at
+// once, so a transfer that is never resumed does not leak memory
+// forever.
+type resumeTracker struct {
+	mu          sync.Mutex
+	windows     map[transferID]*resumeWindow
+	maxWindow   int
+	idleTimeout time.Duration
+}
+
+func newResumeTracker(maxWindow int, idleTimeout time.Duration) *resumeTracker {
+	if maxWindow <= 0 {
+		maxWindow = defaultMaxResumeWindow
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultResumeIdleTimeout
+	}
+	return &resumeTracker{
+		windows:     make(map[transferID]*resumeWindow),
+		maxWindow:   maxWindow,
+		idleTimeout: idleTimeout,
+	}
+}
+
+func (t *resumeTracker) get(id transferID) *resumeWindow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.windows[id]
+	if !ok {
+		w = newResumeWindow(t.idleTimeout)
+		t.windows[id] = w
+	}
+	return w
+}
+
+func (t *resumeTracker) ack(id transferID, chunkID uint64) {
+	t.get(id).ack(chunkID)
+}
+
+// gc discards any tracked window whose transfer has been idle for longer
+// than idleTimeout, half-received data included, then evicts the oldest
+// remaining windows until at most maxWindow transfers are tracked so a
+// burst of abandoned transfers cannot grow this map without bound.
+func (t *resumeTracker) gc() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for id, w := range t.windows {
+		if w.idle(now) {
+			delete(t.windows, id)
+		}
+	}
+	for len(t.windows) > t.maxWindow {
+		oldest := t.oldestLocked()
+		plog.Warningf("resume tracker holding %d transfers, exceeds the %d window, evicting oldest",
+			len(t.windows), t.maxWindow)
+		delete(t.windows, oldest)
+	}
+}
+
+// oldestLocked returns the transferID with the least recently updated
+// resumeWindow. t.mu must already be held.
+func (t *resumeTracker) oldestLocked() transferID {
+	var oldestID transferID
+	var oldestWindow *resumeWindow
+	var oldestAt time.Time
+	for id, w := range t.windows {
+		at := w.lastUpdate()
+		if oldestWindow == nil || at.Before(oldestAt) {
+			oldestID, oldestWindow, oldestAt = id, w, at
+		}
+	}
+	return oldestID
+}